@@ -1,7 +1,10 @@
 package othello
 
 import (
+	"context"
 	"io/ioutil"
+	"strings"
+	"time"
 
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/log"
@@ -11,6 +14,10 @@ import (
 	"net/http"
 )
 
+// thinkTime bounds how long Evaluate is allowed to search before the
+// handler must respond.
+const thinkTime = 2 * time.Second
+
 func init() {
 	http.HandleFunc("/", getMove)
 }
@@ -19,6 +26,50 @@ type Game struct {
 	Board Board `json:board`
 }
 
+// ResponseType identifies what kind of result getMove produced.
+type ResponseType string
+
+const (
+	MoveTypeResponse       ResponseType = "move"
+	PassTypeResponse       ResponseType = "pass"
+	GameOverTypeResponse   ResponseType = "gameOver"
+	InvalidRequestResponse ResponseType = "invalidRequest"
+	IllegalBoardResponse   ResponseType = "illegalBoard"
+)
+
+// Response is the JSON body getMove writes back to the client. Move,
+// Reason, Score, and Board are only set when relevant to Type.
+type Response struct {
+	Type   ResponseType `json:"type"`
+	Move   *Position    `json:"move,omitempty"`
+	Reason Violation    `json:"reason,omitempty"`
+	Score  *FinalScore  `json:"score,omitempty"`
+	Board  *Board       `json:"board,omitempty"`
+}
+
+// Violation is a machine-readable reason a request was rejected.
+type Violation string
+
+const (
+	NoValidJSON     Violation = "NoValidJSON"
+	BoardOutOfRange Violation = "BoardOutOfRange"
+	NextPieceEmpty  Violation = "NextPieceEmpty"
+	EngineTimeout   Violation = "EngineTimeout"
+	IllegalMove     Violation = "IllegalMove"
+)
+
+// acceptsHTML reports whether r prefers an HTML response, which decides
+// whether getMove serves the human paste form instead of JSON.
+func acceptsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// writeResponse marshals resp as JSON to w.
+func writeResponse(w http.ResponseWriter, resp Response) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(resp)
+}
+
 func getMove(w http.ResponseWriter, r *http.Request) {
 	ctx := appengine.NewContext(r)
 	var js []byte
@@ -28,30 +79,49 @@ func getMove(w http.ResponseWriter, r *http.Request) {
 		js = []byte(r.FormValue("json"))
 	}
 	if len(js) < 1 {
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		fmt.Fprintf(w, `
+		if acceptsHTML(r) {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			fmt.Fprintf(w, `
 <body><form method=get>
 Paste JSON here:<p/><textarea name=json cols=80 rows=24></textarea>
 <p/><input type=submit>
 </form>
 </body>`)
+			return
+		}
+		writeResponse(w, Response{Type: InvalidRequestResponse, Reason: NoValidJSON})
 		return
 	}
 	var game Game
 	err := json.Unmarshal(js, &game)
 	if err != nil {
-		fmt.Fprintf(w, "invalid json %v? %v", string(js), err)
+		writeResponse(w, Response{Type: InvalidRequestResponse, Reason: NoValidJSON})
 		return
 	}
 	board := game.Board
+	if reason := board.Validate(); reason != "" {
+		writeResponse(w, Response{Type: IllegalBoardResponse, Reason: reason})
+		return
+	}
 	log.Infof(ctx, "got board: %v", board)
-	moves := board.ValidMoves()
-	if len(moves) < 1 {
-		fmt.Fprintf(w, "PASS")
+	switch board.GameState() {
+	case GameOver:
+		score := board.FinalScore()
+		writeResponse(w, Response{Type: GameOverTypeResponse, Score: &score})
+		return
+	case MustPass:
+		writeResponse(w, Response{Type: PassTypeResponse})
 		return
 	}
-	move := board.EvaluateFromValidMoves(moves)
-	fmt.Fprintf(w, "[%d,%d]", move.Where[0], move.Where[1])
+
+	thinkCtx, cancel := context.WithTimeout(ctx, thinkTime)
+	defer cancel()
+	move := board.Evaluate(thinkCtx)
+	if move.Where.Pass() {
+		writeResponse(w, Response{Type: InvalidRequestResponse, Reason: EngineTimeout})
+		return
+	}
+	writeResponse(w, Response{Type: MoveTypeResponse, Move: &move.Where})
 }
 
 
@@ -83,6 +153,17 @@ type Board struct {
 	Pieces [8][8]Piece
 	// Next says what the color of the next piece played must be.
 	Next Piece
+	// History records every move (and pass) executed so far, in order,
+	// so Undo can revert them without replaying from the start.
+	History []HistoryEntry
+}
+
+// HistoryEntry records one executed move alongside the squares it
+// flipped, so Undo can restore the prior board state directly instead
+// of replaying History from the initial position.
+type HistoryEntry struct {
+	Move     Move
+	Captures []Position
 }
 
 // Position represents a position on the othello board. Valid board
@@ -109,6 +190,29 @@ type Move struct {
 	As Piece
 }
 
+// Validate checks b for problems that would make it unsafe to search or
+// play on, returning the Violation describing the first one found, or
+// "" if b is valid.
+func (b *Board) Validate() Violation {
+	switch b.Next {
+	case Empty:
+		return NextPieceEmpty
+	case Black, White:
+	default:
+		return BoardOutOfRange
+	}
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			switch b.Pieces[y][x] {
+			case Empty, Black, White:
+			default:
+				return BoardOutOfRange
+			}
+		}
+	}
+	return ""
+}
+
 // At returns a pointer to the piece at a given position.
 func (b *Board) At(p Position) *Piece {
 	return &b.Pieces[p[1]-1][p[0]-1]
@@ -120,12 +224,21 @@ func (b *Board) Get(p Position) Piece {
 }
 
 // Exec runs a move on a given Board, updating the given board, and
-// returning it. Returns error if the move is illegal.
+// returning it. Returns error if the move is illegal, including if m.As
+// doesn't match whose turn it actually is. m.As is not checked for a
+// pass, which is legal only when b.Next has no valid moves.
 func (b *Board) Exec(m Move) (*Board, error) {
+	if !m.Where.Pass() && m.As != b.Next {
+		return nil, fmt.Errorf("%v illegal move: it's %v's turn, not %v's", m, b.Next, m.As)
+	}
+
+	var captures []Position
 	if !m.Where.Pass() {
-		if _, err := b.realMove(m); err != nil {
+		caps, err := b.realMove(m)
+		if err != nil {
 			return b, err
 		}
+		captures = caps
 	} else {
 		// Attempting to pass.
 		valid := b.ValidMoves()
@@ -133,12 +246,50 @@ func (b *Board) Exec(m Move) (*Board, error) {
 			return nil, fmt.Errorf("%v illegal move: there are valid moves available: %v", m, valid)
 		}
 	}
+	b.History = append(b.History, HistoryEntry{Move: m, Captures: captures})
 	b.Next = b.Next.Opposite()
 	return b, nil
 }
 
-// realMove executes a move that isn't a PASS.
-func (b *Board) realMove(m Move) (*Board, error) {
+// Undo reverts the last move recorded in History, restoring the board to
+// its state immediately before that move (or pass) was executed. Returns
+// an error if History is empty.
+func (b *Board) Undo() error {
+	if len(b.History) == 0 {
+		return fmt.Errorf("Undo: no moves to undo")
+	}
+	last := b.History[len(b.History)-1]
+	b.History = b.History[:len(b.History)-1]
+	b.Next = b.Next.Opposite()
+
+	if last.Move.Where.Pass() {
+		return nil
+	}
+
+	opponent := last.Move.As.Opposite()
+	for _, p := range last.Captures {
+		*b.At(p) = opponent
+	}
+	*b.At(last.Move.Where) = Empty
+	return nil
+}
+
+// Replay reconstructs a game by executing moves, in order, starting from
+// b's current state. Returns an error if any move in the transcript is
+// illegal.
+func (b *Board) Replay(moves []Move) (*Board, error) {
+	board := *b
+	for _, m := range moves {
+		if _, err := board.Exec(m); err != nil {
+			return nil, err
+		}
+	}
+	return &board, nil
+}
+
+// realMove executes a move that isn't a PASS, returning the squares it
+// flipped (not including the placed piece itself).
+func (b *Board) realMove(m Move) ([]Position, error) {
 	captures, err := b.tryMove(m)
 	if err != nil {
 		return nil, err
@@ -147,7 +298,7 @@ func (b *Board) realMove(m Move) (*Board, error) {
 	for _, p := range append(captures, m.Where) {
 		*b.At(p) = m.As
 	}
-	return b, nil
+	return captures, nil
 }
 
 type direction Position
@@ -219,18 +370,11 @@ func (b *Board) ValidMoves() []Move {
 	return moves
 }
 
-func (b *Board) NextBoard(m Move) Board {
-	board := *b
-	board.Pieces[m.Where[0] - 1][m.Where[1] - 1] = board.Next
-	board.Next = board.Next.Opposite()
-	return board
-}
-
 func (b *Board) GetGameCount() int {
 	cnt := 0
 	for y := 1; y <= 8; y++ {
 		for x := 1; x <= 8; x++ {
-			if b.Pieces[x][y] != 0 {
+			if b.Pieces[y-1][x-1] != 0 {
 				cnt += 1
 			}
 		}
@@ -243,10 +387,10 @@ func (b *Board) ScoreDifference() int {
 	myColor := b.Next
 	for y := 1; y <= 8; y++ {
 		for x := 1; x <= 8; x++ {
-			if b.Pieces[x][y] == myColor {
+			if b.Pieces[y-1][x-1] == myColor {
 				score += 1
 			}
-			if b.Pieces[x][y] == myColor.Opposite() {
+			if b.Pieces[y-1][x-1] == myColor.Opposite() {
 				score -= 1
 			}
 		}
@@ -254,74 +398,215 @@ func (b *Board) ScoreDifference() int {
 	return score
 }
 
-func (b *Board) Evaluate(moves []Move) Move{
-	cnt := b.GetGameCount()
+// discCounts returns the number of Black and White pieces on the board.
+func (b *Board) discCounts() (black, white int) {
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			switch b.Pieces[y][x] {
+			case Black:
+				black++
+			case White:
+				white++
+			}
+		}
+	}
+	return black, white
+}
+
+// GameState describes whether b.Next can move, must pass, or the game
+// has ended.
+type GameState int
+
+const (
+	InProgress GameState = iota
+	MustPass
+	GameOver
+)
+
+// GameState reports whether b.Next has a valid move, must pass because
+// only its opponent does, or the game is over because neither side does.
+func (b *Board) GameState() GameState {
+	if len(b.ValidMoves()) > 0 {
+		return InProgress
+	}
+	if len(b.opponentMoves()) > 0 {
+		return MustPass
+	}
+	return GameOver
+}
+
+// Winner returns the piece with more discs on the board, or Empty on a
+// tie. Only meaningful once GameState returns GameOver.
+func (b *Board) Winner() Piece {
+	black, white := b.discCounts()
 	switch {
-	case cnt < 30:
-		return b.EvaluateFromValidMoves(moves)
-	case cnt < 55:
-		return b.EvaluateFromBoadStatus(moves)
+	case black > white:
+		return Black
+	case white > black:
+		return White
 	default:
-		return b.EvaluateFromCaptures(moves)
+		return Empty
 	}
 }
 
-func (b *Board) EvaluateFromBoadStatus(moves []Move) []Move {
-	boadEvaluate := [4][4]int{{68, -12, 53, -8},{-12, -62, -33, -7},{53, -33, 26, 8},{-8, -7, 8, -18}}
-	max := -100
-	var vestMove Move
-	for _, move := range moves {
-		column := move.Where[0] - 1
-		row := move.Where[1] - 1
-		if column >= 4 {
-			column = 7 - column
-		}
-		if row >= 4 {
-			row = 7 - row
+// FinalScore reports the final disc counts for a finished game.
+type FinalScore struct {
+	Black int
+	White int
+	Empty int
+}
+
+// FinalScore returns the disc counts for b. Only meaningful once
+// GameState returns GameOver.
+func (b *Board) FinalScore() FinalScore {
+	black, white := b.discCounts()
+	return FinalScore{Black: black, White: white, Empty: 64 - black - white}
+}
+
+// Evaluate picks the best move for b.Next by running iterative-deepening
+// Negamax search until ctx is done.
+func (b *Board) Evaluate(ctx context.Context) Move {
+	_, move := b.IterativeDeepening(ctx)
+	return move
+}
+
+// maxScore bounds the evaluation range; terminalScore uses a fraction of
+// it so a won/lost game always outweighs any positional evaluation.
+const maxScore = 1 << 30
+
+// maxSearchDepth caps iterative deepening so it terminates even if ctx
+// never expires (e.g. a background/offline caller with context.Background()).
+const maxSearchDepth = 30
+
+// IterativeDeepening runs Negamax at increasing depths, keeping the best
+// move found by the deepest search, until ctx is done. A depth cut short
+// by ctx replaces the previous result only if it found a move. This is
+// what lets the App Engine handler bound the engine's thinking time: pass
+// a context with a deadline, and both the depth loop here and the move
+// loop inside Negamax stop as soon as it expires.
+func (b *Board) IterativeDeepening(ctx context.Context) (int, Move) {
+	var score int
+	var move Move
+	for depth := 1; depth <= maxSearchDepth; depth++ {
+		if ctx.Err() != nil {
+			return score, move
 		}
-		if boadEvaluate[column][row] > max {
-			max = boadEvaluate[column][row]
-			vestMove = move
+		s, m := b.Negamax(ctx, depth, -maxScore, maxScore)
+		if ctx.Err() != nil {
+			// This depth may have been cut short partway through the
+			// move loop; only adopt it if it actually found a move.
+			if !m.Where.Pass() {
+				score, move = s, m
+			}
+			return score, move
 		}
+		score, move = s, m
 	}
-	return vestMove
+	return score, move
 }
 
-func (b *Board) EvaluateFromValidMoves(moves []Move) Move {
-	var vestMove Move
-	min := 100
-	for _, move := range moves {
-		board := *b
-		board.realMove(move)
-		nextMoves := board.ValidMoves()
-		
-		if len(nextMoves) < min {
-			vestMove = move
-			min = len(nextMoves)
+// boadWeights scores corner/edge squares; the board is folded into one
+// quadrant since the table is symmetric.
+var boadWeights = [4][4]int{{68, -12, 53, -8}, {-12, -62, -33, -7}, {53, -33, 26, 8}, {-8, -7, 8, -18}}
+
+// positionalScore sums boadWeights over the whole board from b.Next's
+// perspective.
+func (b *Board) positionalScore() int {
+	score := 0
+	for y := 1; y <= 8; y++ {
+		for x := 1; x <= 8; x++ {
+			column := x - 1
+			row := y - 1
+			if column >= 4 {
+				column = 7 - column
+			}
+			if row >= 4 {
+				row = 7 - row
+			}
+			weight := boadWeights[column][row]
+			switch b.Pieces[y-1][x-1] {
+			case b.Next:
+				score += weight
+			case b.Next.Opposite():
+				score -= weight
+			}
 		}
 	}
-	return vestMove
+	return score
+}
+
+// opponentMoves returns the moves available to b.Next's opponent.
+func (b *Board) opponentMoves() []Move {
+	opponent := *b
+	opponent.Next = b.Next.Opposite()
+	return opponent.ValidMoves()
 }
 
-func (b *Board) EvaluateFromCaptures(moves []Move) Move {
-	var vestMove Move
-	max := 0
-	for _, move := range moves {
-		captures, _ := b.tryMove(move)
-		if len(captures) > max {
-			vestMove = move
-			max = len(captures)
+// evaluate blends positionalScore with mobility and disc differential,
+// from b.Next's perspective. The coefficients shift with GetGameCount:
+// the opening favors mobility, the midgame favors position, and the
+// endgame (>=55 discs) favors disc count.
+func (b *Board) evaluate() int {
+	mobility := len(b.ValidMoves()) - len(b.opponentMoves())
+	positional := b.positionalScore()
+	discs := b.ScoreDifference()
+
+	switch cnt := b.GetGameCount(); {
+	case cnt < 20:
+		return mobility*15 + positional
+	case cnt < 55:
+		return positional + mobility*3 + discs
+	default:
+		return discs*100 + positional
+	}
+}
+
+// terminalScore returns a large-magnitude score proportional to the
+// final disc differential, used once neither side has a valid move.
+func (b *Board) terminalScore() int {
+	return b.ScoreDifference() * (maxScore / 64)
+}
+
+// Negamax searches to the given depth, returning the score and best move
+// for b.Next. At depth 0 it returns evaluate(). If b.Next has no valid
+// moves, it checks whether the opponent does: if not, the game is over
+// and terminalScore is returned; otherwise b.Next passes by recursing
+// with Next flipped and no move consumed. The move loop bails as soon as
+// ctx is done, so a single deep search can't run past the caller's
+// thinking-time budget.
+func (b *Board) Negamax(ctx context.Context, depth int, alpha, beta int) (int, Move) {
+	if depth == 0 {
+		return b.evaluate(), Move{}
+	}
+
+	moves := b.ValidMoves()
+	if len(moves) == 0 {
+		if len(b.opponentMoves()) == 0 {
+			return b.terminalScore(), Move{}
 		}
+		passed := *b
+		passed.Next = b.Next.Opposite()
+		score, _ := passed.Negamax(ctx, depth-1, -beta, -alpha)
+		return -score, Move{}
 	}
-	return vestMove
-}
-// func (b *Board) Negamax_aux(color Piece, depth int, alpha int, beta int) {
-// 	if depth == 0 {
-// 		return b.ScoreDifference()
-// 	}
-// 	moves = b.ValidMoves()
-// 	if len(moves) == 0 {
-// 		return b.
-		
-// 	}
-// }
+
+	var best Move
+	for _, m := range moves {
+		if ctx.Err() != nil {
+			break
+		}
+		next := *b
+		next.realMove(m)
+		next.Next = next.Next.Opposite()
+		score, _ := next.Negamax(ctx, depth-1, -beta, -alpha)
+		score = -score
+		if score > alpha {
+			alpha = score
+			best = m
+		}
+		if alpha >= beta {
+			break
+		}
+	}
+	return alpha, best
+}
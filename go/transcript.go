@@ -0,0 +1,64 @@
+package othello
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"google.golang.org/appengine"
+)
+
+func init() {
+	http.HandleFunc("/replay", replayGame)
+}
+
+// Transcript is the JSON body POSTed to /replay: a sequence of moves to
+// reconstruct a game from the standard starting position.
+type Transcript struct {
+	Moves []Move `json:"moves"`
+}
+
+// replayGame reconstructs a board from a POSTed transcript of moves and
+// responds with the resulting board plus the engine's chosen next move.
+func replayGame(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	defer r.Body.Close()
+	js, err := ioutil.ReadAll(r.Body)
+	if err != nil || len(js) < 1 {
+		writeResponse(w, Response{Type: InvalidRequestResponse, Reason: NoValidJSON})
+		return
+	}
+
+	var transcript Transcript
+	if err := json.Unmarshal(js, &transcript); err != nil {
+		writeResponse(w, Response{Type: InvalidRequestResponse, Reason: NoValidJSON})
+		return
+	}
+
+	board, err := newGameBoard().Replay(transcript.Moves)
+	if err != nil {
+		writeResponse(w, Response{Type: InvalidRequestResponse, Reason: IllegalMove})
+		return
+	}
+
+	switch board.GameState() {
+	case GameOver:
+		score := board.FinalScore()
+		writeResponse(w, Response{Type: GameOverTypeResponse, Score: &score, Board: board})
+		return
+	case MustPass:
+		writeResponse(w, Response{Type: PassTypeResponse, Board: board})
+		return
+	}
+
+	thinkCtx, cancel := context.WithTimeout(ctx, thinkTime)
+	defer cancel()
+	move := board.Evaluate(thinkCtx)
+	if move.Where.Pass() {
+		writeResponse(w, Response{Type: InvalidRequestResponse, Reason: EngineTimeout, Board: board})
+		return
+	}
+	board.Exec(move)
+	writeResponse(w, Response{Type: MoveTypeResponse, Move: &move.Where, Board: board})
+}
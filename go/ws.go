@@ -0,0 +1,202 @@
+package othello
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// sessionTTL bounds how long a keyed session is kept in memory without
+// any activity before it's evicted.
+const sessionTTL = 10 * time.Minute
+
+func init() {
+	http.HandleFunc("/ws", serveGame)
+}
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     func(r *http.Request) bool { return true },
+}
+
+// SessionMessageType identifies what kind of message is exchanged over a
+// /ws connection.
+type SessionMessageType string
+
+const (
+	ColorDeterminedMessage SessionMessageType = "colorDetermined"
+	MoveMessage            SessionMessageType = "move"
+	PassMessage            SessionMessageType = "pass"
+	InvalidMoveMessage     SessionMessageType = "invalidMove"
+	GameEndedMessage       SessionMessageType = "gameEnded"
+)
+
+// SessionMessage is the wire format for /ws: sent by the server to
+// announce the client's color, the engine's move, a pass made on the
+// client's behalf, a rejected client move, or the game's end, and sent
+// by the client to submit a move.
+type SessionMessage struct {
+	Type   SessionMessageType `json:"type"`
+	Color  Piece              `json:"color,omitempty"`
+	Move   *Position          `json:"move,omitempty"`
+	Reason Violation          `json:"reason,omitempty"`
+	Score  int                `json:"score,omitempty"`
+	Black  int                `json:"black,omitempty"`
+	White  int                `json:"white,omitempty"`
+}
+
+// session holds the authoritative board for one in-progress game played
+// over a WebSocket connection, so the client can never push a full board
+// and have the server simply trust it. Keying sessions by an id the
+// client supplies lets a dropped connection reconnect mid-game and pick
+// the same board back up.
+type session struct {
+	board      *Board
+	lastActive time.Time
+}
+
+var (
+	sessionsMu sync.Mutex
+	sessions   = map[string]*session{}
+)
+
+func init() {
+	go evictStaleSessions()
+}
+
+// evictStaleSessions periodically removes keyed sessions that have seen
+// no activity for sessionTTL, so a client that abandons a game without
+// ever reconnecting doesn't leak its board forever.
+func evictStaleSessions() {
+	for range time.Tick(time.Minute) {
+		sessionsMu.Lock()
+		for id, sess := range sessions {
+			if time.Since(sess.lastActive) > sessionTTL {
+				delete(sessions, id)
+			}
+		}
+		sessionsMu.Unlock()
+	}
+}
+
+// newGameBoard returns the standard Othello starting position with
+// Black to move.
+func newGameBoard() *Board {
+	board := &Board{Next: Black}
+	board.Pieces[3][3] = White
+	board.Pieces[4][4] = White
+	board.Pieces[3][4] = Black
+	board.Pieces[4][3] = Black
+	return board
+}
+
+// serveGame upgrades r to a WebSocket and drives a full Othello game as
+// a stream of SessionMessages: colorDetermined once on connect, then
+// move/pass/invalidMove/gameEnded as the game progresses. The client always
+// plays Black; the server plays White via Board.Evaluate.
+func serveGame(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	id := r.URL.Query().Get("session")
+	keyed := id != ""
+	if !keyed {
+		id = fmt.Sprintf("%p", conn)
+	}
+
+	sessionsMu.Lock()
+	sess, ok := sessions[id]
+	if !ok {
+		sess = &session{board: newGameBoard()}
+		sessions[id] = sess
+	}
+	sess.lastActive = time.Now()
+	sessionsMu.Unlock()
+
+	if !keyed {
+		// Without a client-supplied id to reconnect with, there's no
+		// way to pick this session back up, so there's no reason to
+		// keep it alive past this connection.
+		defer func() {
+			sessionsMu.Lock()
+			delete(sessions, id)
+			sessionsMu.Unlock()
+		}()
+	}
+
+	conn.WriteJSON(SessionMessage{Type: ColorDeterminedMessage, Color: Black})
+
+	for {
+		var msg SessionMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			return
+		}
+		if msg.Move == nil {
+			continue
+		}
+
+		move := Move{Where: *msg.Move, As: sess.board.Next}
+		if _, err := sess.board.Exec(move); err != nil {
+			conn.WriteJSON(SessionMessage{Type: InvalidMoveMessage, Reason: IllegalMove})
+			continue
+		}
+
+		sessionsMu.Lock()
+		sess.lastActive = time.Now()
+		sessionsMu.Unlock()
+
+		if sess.playEngineTurn(conn) {
+			sessionsMu.Lock()
+			delete(sessions, id)
+			sessionsMu.Unlock()
+			return
+		}
+	}
+}
+
+// playEngineTurn lets the engine (White) play until it's the client's
+// (Black's) turn again, passing on the engine's behalf whenever it has
+// no valid moves, and reports the game's end if neither side can move.
+// Returns true once the game has ended, so the caller should stop
+// driving the connection.
+func (s *session) playEngineTurn(conn *websocket.Conn) bool {
+	for s.board.Next != Black {
+		if len(s.board.ValidMoves()) == 0 {
+			s.board.Exec(Move{})
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), thinkTime)
+		move := s.board.Evaluate(ctx)
+		cancel()
+		s.board.Exec(move)
+		conn.WriteJSON(SessionMessage{Type: MoveMessage, Move: &move.Where})
+	}
+
+	switch s.board.GameState() {
+	case InProgress:
+		return false
+	case MustPass:
+		// Black has no moves but White does: pass on Black's behalf and
+		// let the engine play again.
+		s.board.Exec(Move{})
+		conn.WriteJSON(SessionMessage{Type: PassMessage})
+		return s.playEngineTurn(conn)
+	}
+
+	score := s.board.FinalScore()
+	conn.WriteJSON(SessionMessage{
+		Type:  GameEndedMessage,
+		Score: s.board.ScoreDifference(),
+		Black: score.Black,
+		White: score.White,
+	})
+	return true
+}